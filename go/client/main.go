@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"golang.org/x/net/http2"
+
+	"github.com/spraints/improved-engine/go/internal/trace"
 )
 
 func main() {
@@ -30,6 +32,7 @@ func main() {
 	threads := flag.Int("threads", 1, "number of concurrent clients to run")
 	interval := flag.Duration("interval", 0, "time between requests")
 	verbose := flag.Bool("verbose", false, "report every response")
+	traceFlag := flag.String("trace", "", "if set, record the decrypted HTTP/2 bytes received on every connection to this file for offline decoding with h2trace -file")
 
 	flag.Parse()
 
@@ -61,11 +64,46 @@ func main() {
 	http2Transport.WriteByteTimeout = *writeByteTimeout
 	http2Transport.PingTimeout = *pingTimeout
 
+	var roundTripper http.RoundTripper = transport
+
+	if *traceFlag != "" {
+		traceFile, err := os.OpenFile(*traceFlag, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer traceFile.Close()
+		traceWriter := trace.NewWriter(traceFile)
+
+		traceDialTLSContext := func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return traceWriter.NewConn(conn), nil
+		}
+
+		// Ordinary requests run through transport (the *http.Transport*),
+		// which dials and terminates TLS itself and only hands the
+		// resulting *tls.Conn* to http2Transport via TLSNextProto once ALPN
+		// negotiates "h2" - setting DialTLSContext on http2Transport (which
+		// http2.ConfigureTransports wires up to dial only through that
+		// upgrade path) has no effect on it. Route requests through a
+		// separate, directly-constructed http2.Transport instead, which
+		// dials connections itself using the hook above.
+		roundTripper = &http2.Transport{
+			DialTLSContext:   traceDialTLSContext,
+			TLSClientConfig:  tlsConfig,
+			ReadIdleTimeout:  *readIdleTimeout,
+			WriteByteTimeout: *writeByteTimeout,
+			PingTimeout:      *pingTimeout,
+		}
+	}
+
 	ctx := context.Background()
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
-	client := &http.Client{Transport: transport}
+	client := &http.Client{Transport: roundTripper}
 
 	log.Printf("starting %d goroutines...", *threads)
 
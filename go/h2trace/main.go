@@ -0,0 +1,297 @@
+// Command h2trace either opens a raw TLS connection to an HTTP/2 server,
+// sends a single request by hand, and prints every frame it sees in a
+// human-readable form, or (with -file) replays a recording made by the
+// client command's -trace flag and decodes it offline. It exists because
+// GODEBUG=http2debug=1 (used by the frame-size experiment) produces output
+// that's hard to parse and doesn't show HPACK-decoded headers, window
+// sizes, or PING round-trip times.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/spraints/improved-engine/go/internal/trace"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:5623", "host:port to connect to")
+	scheme := flag.String("scheme", "https", ":scheme pseudo-header to send")
+	authority := flag.String("authority", "", ":authority pseudo-header to send (defaults to -addr)")
+	method := flag.String("method", "GET", ":method pseudo-header to send")
+	path := flag.String("path", "/", ":path pseudo-header to send")
+	traceHex := flag.Bool("trace-hex", false, "also dump the raw bytes of each frame")
+	tracePing := flag.Duration("trace-ping", 0, "if set, send a PING at this interval and print RTT")
+	file := flag.String("file", "", "if set, decode a recording made by the client command's -trace flag instead of connecting live")
+	flag.Parse()
+
+	if *file != "" {
+		decodeFile(*file, *traceHex)
+		return
+	}
+
+	if *authority == "" {
+		*authority = *addr
+	}
+
+	conn, err := tls.Dial("tcp", *addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	log.Printf("connected to %v, negotiated protocol %q", *addr, conn.ConnectionState().NegotiatedProtocol)
+
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		log.Fatal(err)
+	}
+
+	tee := &teeConn{Conn: conn}
+	framer := http2.NewFramer(tee, tee)
+	framer.ReadMetaHeaders = nil
+
+	if err := framer.WriteSettings(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeRequest(framer, *method, *scheme, *authority, *path); err != nil {
+		log.Fatal(err)
+	}
+
+	pinger := newPinger(framer)
+	if *tracePing > 0 {
+		go pinger.loop(*tracePing)
+	}
+
+	decoder := hpack.NewDecoder(4096, nil)
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			log.Fatalf("read frame: %v", err)
+		}
+
+		if *traceHex {
+			fmt.Printf("%s\n", hex.Dump(tee.lastFrame()))
+		}
+
+		printFrame(frame, decoder, pinger)
+	}
+}
+
+// decodeFile replays every connection recorded in the file at path and
+// prints its frames in turn. Unlike the live path, frames come from a
+// server-only byte stream with no write side, so a framer is built with an
+// io.Discard writer, and running out of bytes (io.EOF/io.ErrUnexpectedEOF)
+// just ends that connection's replay instead of being fatal.
+func decodeFile(path string, traceHex bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	conns, err := trace.ReadConns(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i, r := range conns {
+		fmt.Printf("==== connection %d ====\n", i)
+
+		tee := &teeConn{Conn: readOnlyConn{r}}
+		framer := http2.NewFramer(io.Discard, tee)
+		framer.ReadMetaHeaders = nil
+		decoder := hpack.NewDecoder(4096, nil)
+		pinger := newPinger(framer) // only its ack() bookkeeping is used; nothing ever calls loop()
+
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				log.Fatalf("connection %d: read frame: %v", i, err)
+			}
+
+			if traceHex {
+				fmt.Printf("%s\n", hex.Dump(tee.lastFrame()))
+			}
+
+			printFrame(frame, decoder, pinger)
+		}
+	}
+}
+
+// readOnlyConn adapts an io.Reader to net.Conn so it can be wrapped by
+// teeConn; only Read is ever called on it during decodeFile.
+type readOnlyConn struct {
+	io.Reader
+}
+
+func (readOnlyConn) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("h2trace: write to a read-only recording")
+}
+func (readOnlyConn) Close() error                     { return nil }
+func (readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// writeRequest HPACK-encodes the pseudo-headers for a simple request and
+// sends them as a single HEADERS frame on stream 1.
+func writeRequest(framer *http2.Framer, method, scheme, authority, path string) error {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: scheme},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: path},
+	} {
+		if err := enc.WriteField(f); err != nil {
+			return err
+		}
+	}
+
+	return framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+}
+
+// printFrame prints a one-line, human-readable summary of frame, followed
+// by indented lines with its type-specific details (settings, decoded
+// headers, and so on).
+func printFrame(frame http2.Frame, decoder *hpack.Decoder, pinger *pinger) {
+	hdr := frame.Header()
+	fmt.Printf("<- %-14v len=%-6d stream=%-3d flags=%v\n", hdr.Type, hdr.Length, hdr.StreamID, hdr.Flags)
+
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		f.ForeachSetting(func(s http2.Setting) error {
+			fmt.Printf("     %v = %v\n", s.ID, s.Val)
+			return nil
+		})
+	case *http2.WindowUpdateFrame:
+		fmt.Printf("     increment=%v\n", f.Increment)
+	case *http2.PingFrame:
+		if f.IsAck() {
+			pinger.ack(f.Data)
+		} else {
+			fmt.Printf("     data=%x\n", f.Data)
+		}
+	case *http2.GoAwayFrame:
+		fmt.Printf("     lastStreamID=%v errCode=%v debugData=%q\n", f.LastStreamID, f.ErrCode, f.DebugData())
+	case *http2.HeadersFrame:
+		fields, err := decoder.DecodeFull(f.HeaderBlockFragment())
+		if err != nil {
+			fmt.Printf("     hpack decode error: %v\n", err)
+			return
+		}
+		for _, hf := range fields {
+			fmt.Printf("     %v: %v\n", hf.Name, hf.Value)
+		}
+	case *http2.DataFrame:
+		fmt.Printf("     %d bytes\n", len(f.Data()))
+	case *http2.RSTStreamFrame:
+		fmt.Printf("     errCode=%v\n", f.ErrCode)
+	}
+}
+
+// pinger sends PINGs on an interval and reports the round-trip time for
+// each ACK it sees.
+type pinger struct {
+	framer *http2.Framer
+
+	mu   sync.Mutex
+	sent map[[8]byte]time.Time
+}
+
+func newPinger(framer *http2.Framer) *pinger {
+	return &pinger{framer: framer, sent: map[[8]byte]time.Time{}}
+}
+
+func (p *pinger) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var data [8]byte
+		rand.Read(data[:])
+
+		p.mu.Lock()
+		p.sent[data] = time.Now()
+		p.mu.Unlock()
+
+		if err := p.framer.WritePing(false, data); err != nil {
+			log.Printf("ping: %v", err)
+			return
+		}
+	}
+}
+
+func (p *pinger) ack(data [8]byte) {
+	p.mu.Lock()
+	sentAt, ok := p.sent[data]
+	if ok {
+		delete(p.sent, data)
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		fmt.Printf("     data=%x (unmatched ack)\n", data)
+		return
+	}
+	fmt.Printf("     data=%x rtt=%v\n", data, time.Since(sentAt))
+}
+
+// teeConn wraps a net.Conn and accumulates the bytes read since the last
+// lastFrame call, so callers can print the raw bytes that made up a decoded
+// frame. http2.Framer reads each frame's header and payload with no
+// read-ahead buffering, so calling lastFrame after each ReadFrame lines up
+// with frame boundaries closely enough for -trace-hex's purposes.
+type teeConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	last bytes.Buffer
+}
+
+func (c *teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.last.Write(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// lastFrame returns and clears the bytes accumulated since the previous
+// call.
+func (c *teeConn) lastFrame() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := append([]byte(nil), c.last.Bytes()...)
+	c.last.Reset()
+	return b
+}
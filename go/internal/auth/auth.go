@@ -0,0 +1,52 @@
+// Package auth provides pluggable request authentication for the test
+// server, selected at startup by a URL-style -auth flag, e.g.
+// "static://?username=foo&password=bar" or
+// "basicfile://?path=/etc/httpasswd&reload=5s".
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Auth validates incoming requests and can be asked to release any
+// background resources (watchers, tickers) it holds.
+type Auth interface {
+	// Validate reports the authenticated username and whether r is
+	// authorized.
+	Validate(r *http.Request) (user string, ok bool)
+	// Stop releases any background resources started by the Auth.
+	Stop()
+}
+
+// New parses rawURL and constructs the Auth it names. The scheme selects
+// the implementation; the query string configures it (for basicfile, the
+// htpasswd file is named by the "path" query parameter).
+func New(rawURL string) (Auth, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid -auth value %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "static":
+		return newStaticAuth(u.Query())
+	case "basicfile":
+		return newBasicFileAuth(u.Query())
+	default:
+		return nil, fmt.Errorf("auth: unknown scheme %q", u.Scheme)
+	}
+}
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// UserFromContext returns the username stashed in ctx by Middleware, if
+// any.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey).(string)
+	return user, ok
+}
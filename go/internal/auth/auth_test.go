@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStaticAuth(t *testing.T) {
+	a, err := New("static://?username=alice&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.SetBasicAuth("alice", "secret")
+	if user, ok := a.Validate(req); !ok || user != "alice" {
+		t.Fatalf("Validate() = %q, %v; want alice, true", user, ok)
+	}
+
+	req.SetBasicAuth("alice", "wrong")
+	if _, ok := a.Validate(req); ok {
+		t.Fatal("Validate() succeeded with the wrong password")
+	}
+}
+
+func TestBasicFileAuthRotatingFile(t *testing.T) {
+	path := writeHtpasswd(t, shaLine("alice", "secret"))
+
+	a, err := New("basicfile://?" + url.Values{"path": {path}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.SetBasicAuth("alice", "secret")
+	if _, ok := a.Validate(req); !ok {
+		t.Fatal("Validate() failed for the original password")
+	}
+
+	updateHtpasswd(t, path, shaLine("alice", "newsecret"))
+	fa := a.(*basicFileAuth)
+	if err := fa.file.Reload(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	req.SetBasicAuth("alice", "secret")
+	if _, ok := a.Validate(req); ok {
+		t.Fatal("Validate() accepted a password rotated out of the file")
+	}
+
+	req.SetBasicAuth("alice", "newsecret")
+	if _, ok := a.Validate(req); !ok {
+		t.Fatal("Validate() rejected the rotated-in password")
+	}
+}
+
+func TestBasicFileAuthConcurrentReload(t *testing.T) {
+	path := writeHtpasswd(t, shaLine("alice", "secret"))
+
+	a, err := New("basicfile://?" + url.Values{"path": {path}, "reload": {"10ms"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/data", nil)
+			req.SetBasicAuth("alice", "secret")
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					a.Validate(req)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		updateHtpasswd(t, path, shaLine("alice", "secret"))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestMiddleware(t *testing.T) {
+	a, err := New("static://?username=alice&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	var gotUser string
+	var gotOK bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotOK = UserFromContext(r.Context())
+	})
+
+	h := Middleware(a, "", "test", next)
+
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.SetBasicAuth("alice", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", rec.Code)
+	}
+	if !gotOK || gotUser != "alice" {
+		t.Fatalf("UserFromContext() = %q, %v; want alice, true", gotUser, gotOK)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/data", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d; want 401", rec.Code)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="test"` {
+		t.Fatalf("WWW-Authenticate = %q", got)
+	}
+}
+
+func TestMiddlewareHiddenDomain(t *testing.T) {
+	a, err := New("static://?username=alice&password=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := Middleware(a, "probe.example", "test", next)
+
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.Host = "probe.example"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200 for hidden domain", rec.Code)
+	}
+}
+
+// shaLine returns an htpasswd line for user with pass stored in the {SHA}
+// format, one of the formats htpasswd.DefaultSystems accepts.
+func shaLine(user, pass string) string {
+	sum := sha1.Sum([]byte(pass))
+	return user + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+}
+
+func writeHtpasswd(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+	updateHtpasswd(t, path, contents)
+	return path
+}
+
+func updateHtpasswd(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
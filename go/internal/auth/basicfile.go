@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	htpasswd "github.com/tg123/go-htpasswd"
+)
+
+// basicFileAuth validates against an Apache-style htpasswd file. When a
+// reload interval is given, it rereads the file on that timer so password
+// changes take effect without a restart; without one, the file is read
+// only once, at startup. *File is already safe for concurrent Match/Reload
+// calls.
+type basicFileAuth struct {
+	path string
+	file *htpasswd.File
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBasicFileAuth(q url.Values) (Auth, error) {
+	path := q.Get("path")
+	if path == "" {
+		return nil, fmt.Errorf("auth: basicfile:// requires a path")
+	}
+
+	var reload time.Duration
+	if s := q.Get("reload"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("auth: invalid reload interval %q: %w", s, err)
+		}
+		reload = d
+	}
+
+	file, err := htpasswd.New(path, htpasswd.DefaultSystems, logBadLine)
+	if err != nil {
+		return nil, fmt.Errorf("auth: loading %s: %w", path, err)
+	}
+
+	a := &basicFileAuth{path: path, file: file}
+
+	if reload > 0 {
+		a.stop = make(chan struct{})
+		a.done = make(chan struct{})
+		go a.reloadLoop(reload)
+	}
+
+	return a, nil
+}
+
+func (a *basicFileAuth) reloadLoop(interval time.Duration) {
+	defer close(a.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			if err := a.file.Reload(logBadLine); err != nil {
+				log.Printf("auth: reloading %s: %v", a.path, err)
+			}
+		}
+	}
+}
+
+func logBadLine(err error) {
+	log.Printf("auth: bad htpasswd line: %v", err)
+}
+
+// Validate implements Auth.
+func (a *basicFileAuth) Validate(r *http.Request) (string, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || !a.file.Match(user, pass) {
+		return "", false
+	}
+	return user, true
+}
+
+// Stop implements Auth.
+func (a *basicFileAuth) Stop() {
+	if a.stop == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+}
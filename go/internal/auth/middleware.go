@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Middleware challenges every request with a 401 unless it validates
+// against a. Requests whose Host matches hiddenDomain bypass the
+// challenge entirely, which is useful for probing a server without
+// tripping the auth prompt. An authenticated request's username is
+// available downstream via UserFromContext.
+func Middleware(a Auth, hiddenDomain, realm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hiddenDomain != "" && r.Host == hiddenDomain {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := a.Validate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
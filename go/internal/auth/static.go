@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// staticAuth accepts exactly one username/password pair, configured at
+// startup. It's useful for quick manual testing where a file isn't worth
+// the trouble.
+type staticAuth struct {
+	username string
+	password string
+}
+
+func newStaticAuth(q url.Values) (Auth, error) {
+	username := q.Get("username")
+	password := q.Get("password")
+	if username == "" {
+		return nil, fmt.Errorf("auth: static:// requires a username")
+	}
+	return &staticAuth{username: username, password: password}, nil
+}
+
+// Validate implements Auth.
+func (a *staticAuth) Validate(r *http.Request) (string, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != a.username || pass != a.password {
+		return "", false
+	}
+	return user, true
+}
+
+// Stop implements Auth.
+func (a *staticAuth) Stop() {}
@@ -0,0 +1,103 @@
+// Package cache provides a small in-memory, TTL-expiring cache. It exists
+// so the test server can memoize generated payloads instead of recreating
+// them on every request, which makes it easier to isolate network behavior
+// from server CPU when hammering the server with many clients.
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type entry struct {
+	value      interface{}
+	expiration time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return now.After(e.expiration)
+}
+
+// Cache maps string keys to values that expire after a TTL.
+type Cache struct {
+	mu      sync.RWMutex
+	entries map[string]entry
+
+	hits   uint64
+	misses uint64
+}
+
+// New returns an empty Cache.
+func New() *Cache {
+	return &Cache{entries: map[string]entry{}}
+}
+
+// Get returns the value stored for key, treating an expired entry as a
+// miss.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if !ok || e.expired(time.Now()) {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	return e.value, true
+}
+
+// Set stores value under key for ttl.
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry{value: value, expiration: time.Now().Add(ttl)}
+}
+
+// Stats returns the number of Get calls that found a live entry and the
+// number that didn't.
+func (c *Cache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// Sweep removes every expired entry and reports how many it removed. It's
+// meant to be called periodically by a background goroutine so a
+// long-running cache with many distinct keys doesn't grow unbounded.
+func (c *Cache) Sweep() int {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, e := range c.entries {
+		if e.expired(now) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartSweeper runs Sweep on a ticker until the returned stop function is
+// called.
+func (c *Cache) StartSweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.Sweep()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
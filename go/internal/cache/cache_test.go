@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetSet(t *testing.T) {
+	c := New()
+
+	if _, ok := c.Get("missing"); ok {
+		t.Fatal("Get() found a key that was never set")
+	}
+
+	c.Set("a", 1, time.Minute)
+	v, ok := c.Get("a")
+	if !ok || v != 1 {
+		t.Fatalf("Get(%q) = %v, %v; want 1, true", "a", v, ok)
+	}
+
+	if hits, misses := c.Stats(); hits != 1 || misses != 1 {
+		t.Fatalf("Stats() = %d, %d; want 1, 1", hits, misses)
+	}
+}
+
+func TestGetExpired(t *testing.T) {
+	c := New()
+	c.Set("a", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Get() returned an expired entry")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	c := New()
+	c.Set("expired", 1, time.Nanosecond)
+	c.Set("live", 2, time.Minute)
+	time.Sleep(time.Millisecond)
+
+	if removed := c.Sweep(); removed != 1 {
+		t.Fatalf("Sweep() removed %d entries; want 1", removed)
+	}
+
+	if _, ok := c.Get("live"); !ok {
+		t.Fatal("Sweep() removed a live entry")
+	}
+}
+
+func TestStartSweeper(t *testing.T) {
+	c := New()
+	c.Set("expired", 1, time.Nanosecond)
+
+	stop := c.StartSweeper(time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.RLock()
+		_, stillThere := c.entries["expired"]
+		c.mu.RUnlock()
+		if !stillThere {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("sweeper never removed the expired entry")
+}
@@ -0,0 +1,221 @@
+// Package certs generates the ephemeral ECDSA certificates the test server
+// and the mitm proxy need: a self-signed leaf for the server, and a
+// persistent root CA plus on-demand leaves for the proxy.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// GetCerts generates a fresh self-signed server certificate on every call
+// and stores it in dir as server.crt/server.key.
+func GetCerts(dir string) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(dir, "server.crt")
+	keyFile = filepath.Join(dir, "server.key")
+
+	os.Mkdir(dir, 0755)
+	os.Remove(certFile)
+	os.Remove(keyFile)
+
+	key, err := generateKey(keyFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization:       []string{"Spraints"},
+			OrganizationalUnit: []string{"Exp"},
+			CommonName:         "localhost",
+		},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	if _, err := createCert(certFile, template, template, key.Public(), key, 1, 0, 0); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+// CA is a root certificate authority that can issue leaf certificates on
+// demand.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// GetCA loads the CA persisted under dir as ca.crt/ca.key, generating and
+// persisting one if it doesn't exist yet, so a proxy using it presents the
+// same root across restarts.
+func GetCA(dir string) (*CA, error) {
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	if ca, err := loadCA(certFile, keyFile); err == nil {
+		return ca, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	key, err := generateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"Spraints"},
+			CommonName:   "mitm root CA",
+		},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	cert, err := createCert(certFile, template, template, key.Public(), key, 10, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{cert: cert, key: key}, nil
+}
+
+func loadCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("certs: %s is not a PEM certificate", certFile)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("certs: %s is not a PEM key", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{cert: cert, key: key}, nil
+}
+
+// IssueLeaf mints a leaf certificate for host, signed by the CA. It's not
+// persisted; callers that want to avoid reissuing on every connection
+// should cache the result themselves.
+func (ca *CA) IssueLeaf(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"Spraints"}, CommonName: host},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{host},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+		template.DNSNames = nil
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random serial number: %w", err)
+	}
+	template.SerialNumber = serialNumber
+	template.NotBefore = time.Now().Add(-10 * time.Minute)
+	template.NotAfter = time.Now().AddDate(0, 0, 30)
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue leaf certificate for %s: %w", host, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER, ca.cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+func generateKey(keyFile string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize private key for new certificate: %w", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if keyPEM == nil || len(keyPEM) < 1 {
+		return nil, fmt.Errorf("failed to PEM-encode generated certificate's key")
+	}
+
+	if err := os.WriteFile(keyFile, keyPEM, 0444); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// createCert fills in the serial number and validity window on template,
+// self- or CA-signs it against parent, and writes the PEM-encoded result
+// to certFile.
+func createCert(certFile string, template, parent *x509.Certificate, pub interface{}, signerKey *ecdsa.PrivateKey, validYears, validMonths, validDays int) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random serial number: %w", err)
+	}
+	template.SerialNumber = serialNumber
+	template.NotBefore = time.Now().Add(-10 * time.Minute)
+	template.NotAfter = time.Now().AddDate(validYears, validMonths, validDays)
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform certificate generation")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if certPEM == nil || len(certPEM) < 1 {
+		return nil, fmt.Errorf("failed to PEM-encode generated certificate")
+	}
+
+	if err := os.WriteFile(certFile, certPEM, 0444); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(certDER)
+}
@@ -0,0 +1,107 @@
+// Package trace implements a small framing format for recording the
+// decrypted bytes read off one or more net.Conns to a file, so the
+// recording can be replayed and decoded offline later (e.g. by h2trace's
+// -file mode) instead of requiring a live connection at decode time.
+//
+// The file is a sequence of chunks: each the bytes passed to a single Read
+// call on some traced conn, prefixed with a 4-byte connection ID and a
+// 4-byte chunk length (both big-endian). Chunks from different connections
+// may interleave in the file - each connection opened against a Writer
+// gets its own ID, so a reader can demux them and reconstruct each
+// connection's byte stream even across reconnects.
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Writer records chunks from any number of traced connections to w.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	nextID uint32
+}
+
+// NewWriter returns a Writer that records to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// NewConn wraps conn so every successful Read is recorded under a
+// connection ID unique to this Writer.
+func (tw *Writer) NewConn(conn net.Conn) net.Conn {
+	id := atomic.AddUint32(&tw.nextID, 1) - 1
+	return &tracedConn{Conn: conn, tw: tw, id: id}
+}
+
+func (tw *Writer) writeChunk(id uint32, p []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], id)
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(len(p)))
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if _, err := tw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := tw.w.Write(p)
+	return err
+}
+
+type tracedConn struct {
+	net.Conn
+	tw *Writer
+	id uint32
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := c.tw.writeChunk(c.id, p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// ReadConns reads every chunk from r and returns one io.Reader per
+// connection ID, in the order each ID first appeared, replaying that
+// connection's bytes in order.
+func ReadConns(r io.Reader) ([]io.Reader, error) {
+	buffers := map[uint32]*bytes.Buffer{}
+	var order []uint32
+
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("trace: reading chunk header: %w", err)
+		}
+		id := binary.BigEndian.Uint32(hdr[0:4])
+		n := binary.BigEndian.Uint32(hdr[4:8])
+
+		buf, ok := buffers[id]
+		if !ok {
+			buf = &bytes.Buffer{}
+			buffers[id] = buf
+			order = append(order, id)
+		}
+		if _, err := io.CopyN(buf, r, int64(n)); err != nil {
+			return nil, fmt.Errorf("trace: reading chunk of %d bytes for connection %d: %w", n, id, err)
+		}
+	}
+
+	readers := make([]io.Reader, len(order))
+	for i, id := range order {
+		readers[i] = buffers[id]
+	}
+	return readers, nil
+}
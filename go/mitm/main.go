@@ -0,0 +1,309 @@
+// Command mitm is an intercepting HTTPS proxy. It accepts CONNECT requests,
+// terminates TLS locally with a leaf certificate minted on the fly from a
+// generated root CA, and forwards the decrypted requests to the real
+// upstream over the same transport used by the client command. It's meant
+// for watching HTTP/2 client/server behavior (frame stalls, PINGs, GOAWAYs)
+// on traffic that isn't otherwise observable.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/spraints/improved-engine/go/internal/cache"
+	"github.com/spraints/improved-engine/go/internal/certs"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "address for the proxy to listen on")
+	certDir := flag.String("certdir", "certs", "generate a CA (if needed) and store it in this dir")
+	dumpFile := flag.String("dump", "", "if set, dump request/response headers and bodies to this file")
+	dialTimeout := flag.Duration("dial-timeout", 100*time.Millisecond, "dial timeout for upstream client")
+	idleTimeout := flag.Duration("idle-timeout", 10*time.Second, "idle timeout for upstream client")
+	readIdleTimeout := flag.Duration("read-idle-timeout", 2*time.Second, "read idle timeout for upstream http2 client")
+	writeByteTimeout := flag.Duration("write-byte-timeout", time.Second, "write byte timeout for upstream http2 client")
+	pingTimeout := flag.Duration("ping-timeout", 8*time.Second, "ping timeout for upstream http2 client")
+	leafCacheTTL := flag.Duration("leaf-cache-ttl", time.Hour, "how long to cache a minted leaf certificate before reissuing it")
+	verbose := flag.Bool("verbose", false, "log every intercepted request")
+	flag.Parse()
+
+	ca, err := certs.GetCA(*certDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	leafCache := cache.New()
+	stopLeafSweep := leafCache.StartSweeper(*leafCacheTTL)
+	defer stopLeafSweep()
+	issuer := &certIssuer{ca: ca, cache: leafCache, ttl: *leafCacheTTL}
+
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{Timeout: *dialTimeout}).DialContext,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		IdleConnTimeout: *idleTimeout,
+	}
+	h2Transport, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h2Transport.ReadIdleTimeout = *readIdleTimeout
+	h2Transport.WriteByteTimeout = *writeByteTimeout
+	h2Transport.PingTimeout = *pingTimeout
+
+	var dump *dumper
+	if *dumpFile != "" {
+		f, err := os.OpenFile(*dumpFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		dump = &dumper{w: f}
+	}
+
+	p := &proxy{
+		issuer:   issuer,
+		client:   &http.Client{Transport: transport},
+		h2Server: &http2.Server{},
+		verbose:  *verbose,
+		dump:     dump,
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %v", listener.Addr())
+
+	if err := (&http.Server{Handler: p}).Serve(listener); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// proxy is the CONNECT-handling http.Handler. Every other method is rejected;
+// CONNECT hijacks the connection and terminates TLS itself.
+type proxy struct {
+	issuer   *certIssuer
+	client   *http.Client
+	h2Server *http2.Server
+	verbose  bool
+	dump     *dumper
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "mitm: only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "mitm: hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("hijack %v: %v", r.Host, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("connect %v: %v", r.Host, err)
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: p.issuer.certForHost,
+		NextProtos:     []string{"h2", "http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("tls handshake %v: %v", r.Host, err)
+		return
+	}
+
+	upstream := upstreamHost(r.Host)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.forward(w, r, upstream)
+	})
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		p.h2Server.ServeConn(tlsConn, &http2.ServeConnOpts{Handler: handler})
+		return
+	}
+
+	listener := newSingleConnListener(tlsConn)
+	srv := &http.Server{
+		Handler: handler,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	srv.Serve(listener)
+}
+
+// forward dispatches the decrypted request to the real upstream and copies
+// the response back, logging it in the same shape as the test server's
+// loggingWriter.
+func (p *proxy) forward(w http.ResponseWriter, r *http.Request, upstream string) {
+	start := time.Now()
+
+	r.URL.Scheme = "https"
+	r.URL.Host = upstream
+	r.RequestURI = ""
+
+	if p.dump != nil {
+		p.dump.request(r)
+	}
+
+	resp, err := p.client.Do(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		log.Printf("[%v %v] %v %v -> error: %v", r.Proto, upstream, r.Method, r.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if p.dump != nil {
+		p.dump.response(resp)
+	}
+
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		log.Printf("copy body from %v: %v", upstream, err)
+	}
+
+	if p.verbose {
+		log.Printf("[%v %v] %v %v -> %v (%v, %d bytes)",
+			r.Proto, upstream, r.Method, r.URL, resp.StatusCode, time.Since(start), n)
+	}
+}
+
+func upstreamHost(connectHost string) string {
+	if _, _, err := net.SplitHostPort(connectHost); err == nil {
+		return connectHost
+	}
+	return net.JoinHostPort(connectHost, "443")
+}
+
+// singleConnListener turns an already-accepted conn into a net.Listener
+// that yields it exactly once. The caller must call Close once it's done
+// serving the conn (e.g. from http.Server's ConnState hook on
+// StateClosed/StateHijacked) so Accept's second call returns and
+// http.Server.Serve unwinds instead of leaking a goroutine per connection.
+type singleConnListener struct {
+	conn   net.Conn
+	accept chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		conn:   conn,
+		accept: make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+	}
+	l.accept <- conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case c, ok := <-l.accept:
+		if !ok {
+			return nil, io.EOF
+		}
+		return c, nil
+	case <-l.closed:
+		return nil, io.EOF
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// dumper writes request/response headers and bodies to a file for offline
+// inspection. Bodies are drained through httputil.DumpRequest/DumpResponse
+// and restored onto the request/response so forwarding still sees a fresh
+// body.
+type dumper struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (d *dumper) request(r *http.Request) {
+	b, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		log.Printf("dump request: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	fmt.Fprintf(d.w, "---- request %v\n%s\n", time.Now().Format(time.RFC3339Nano), b)
+	d.mu.Unlock()
+}
+
+func (d *dumper) response(resp *http.Response) {
+	b, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		log.Printf("dump response: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	fmt.Fprintf(d.w, "---- response %v\n%s\n", time.Now().Format(time.RFC3339Nano), b)
+	d.mu.Unlock()
+}
+
+// certIssuer mints leaf certificates on demand, signed by the locally
+// generated CA, and caches them by SNI host for ttl so repeated connections
+// to the same host don't regenerate a certificate every time. Using
+// cache.Cache (rather than an unbounded map) means stale entries expire and
+// get swept instead of accumulating forever across the proxy's lifetime.
+type certIssuer struct {
+	ca    *certs.CA
+	cache *cache.Cache
+	ttl   time.Duration
+}
+
+func (i *certIssuer) certForHost(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+	if host == "" {
+		return nil, fmt.Errorf("mitm: client did not send SNI")
+	}
+
+	if cert, ok := i.cache.Get(host); ok {
+		return cert.(*tls.Certificate), nil
+	}
+
+	cert, err := i.ca.IssueLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+	i.cache.Set(host, cert, i.ttl)
+	return cert, nil
+}
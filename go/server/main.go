@@ -1,26 +1,22 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"math"
-	"math/big"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
+
+	"github.com/spraints/improved-engine/go/internal/auth"
+	"github.com/spraints/improved-engine/go/internal/cache"
+	"github.com/spraints/improved-engine/go/internal/certs"
 )
 
 func main() {
@@ -28,19 +24,38 @@ func main() {
 	certDir := flag.String("certdir", "certs", "generate certs (if needed) and store them in this dir")
 	maxStreams := flag.Int("max-streams", 0, "max concurrent streams for http/2 server (0 uses Go's default)")
 	verbose := flag.Bool("verbose", false, "log every request")
+	authFlag := flag.String("auth", "", `require auth, e.g. "static://?username=foo&password=bar" or "basicfile://?path=/etc/httpasswd&reload=5s"`)
+	hiddenDomain := flag.String("hidden-domain", "", "Host that bypasses the auth challenge, for probing without a prompt")
+	cacheTTL := flag.Duration("cache-ttl", 10*time.Second, "default TTL for memoized /data payloads and /cached entries")
+	cacheSweep := flag.Bool("cache-sweep", false, "periodically purge expired cache entries in the background")
 	flag.Parse()
 
-	certFile, keyFile, err := getCerts(*certDir)
+	certFile, keyFile, err := certs.GetCerts(*certDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var a auth.Auth
+	if *authFlag != "" {
+		a, err = auth.New(*authFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer a.Stop()
+	}
+
 	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("listening on %v", listener.Addr())
 
+	dataCache := cache.New()
+	if *cacheSweep {
+		stop := dataCache.StartSweeper(*cacheTTL)
+		defer stop()
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/slow", func(_ http.ResponseWriter, r *http.Request) {
@@ -52,35 +67,62 @@ func main() {
 	})
 
 	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
-		var size, blockSize uint64
-		size, _ = strconv.ParseUint(r.FormValue("bytes"), 10, 32)
-		blockSize, _ = strconv.ParseUint(r.FormValue("bs"), 10, 32)
+		size, _ := strconv.ParseUint(r.FormValue("bytes"), 10, 32)
+		blockSize, _ := strconv.ParseUint(r.FormValue("bs"), 10, 32)
 		if blockSize < 1 {
 			blockSize = 1024 * 1024
 		}
-		data := make([]byte, 0, int(blockSize))
-		for i := 0; i < int(blockSize); i++ {
-			data = append(data, 'a')
+
+		key := fmt.Sprintf("data:%d", blockSize)
+		data, ok := dataCache.Get(key)
+		if !ok {
+			data = genBlock(int(blockSize))
+			dataCache.Set(key, data, *cacheTTL)
 		}
-		rem := int(size)
-		for rem > 0 {
-			toSend := data
-			if rem < len(toSend) {
-				toSend = toSend[:rem]
-			}
-			if sent, err := w.Write(toSend); err != nil {
-				log.Println(err)
-				return
-			} else {
-				rem -= sent
+
+		writeBlock(w, data.([]byte), int(size))
+	})
+
+	mux.HandleFunc("/cached", func(w http.ResponseWriter, r *http.Request) {
+		key := "cached:" + r.FormValue("key")
+
+		ttl := *cacheTTL
+		if s := r.FormValue("ttl"); s != "" {
+			if d, err := time.ParseDuration(s); err == nil {
+				ttl = d
 			}
 		}
+
+		size, _ := strconv.ParseUint(r.FormValue("bytes"), 10, 32)
+		if size < 1 {
+			size = 1024 * 1024
+		}
+
+		data, ok := dataCache.Get(key)
+		if !ok {
+			data = randomBlock(int(size))
+			dataCache.Set(key, data, ttl)
+		}
+
+		writeBlock(w, data.([]byte), len(data.([]byte)))
+	})
+
+	mux.HandleFunc("/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		hits, misses := dataCache.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]uint64{
+			"hits":   hits,
+			"misses": misses,
+		})
 	})
 
 	var h http.Handler = mux
 	if *verbose {
 		h = reqLog(h)
 	}
+	if a != nil {
+		h = auth.Middleware(a, *hiddenDomain, "improved-engine", h)
+	}
 
 	server := &http.Server{Handler: h}
 
@@ -92,6 +134,43 @@ func main() {
 	}
 }
 
+// genBlock returns size bytes of 'a', the same payload /data has always
+// returned.
+func genBlock(size int) []byte {
+	data := make([]byte, 0, size)
+	for i := 0; i < size; i++ {
+		data = append(data, 'a')
+	}
+	return data
+}
+
+// randomBlock returns size bytes of random data, suitable for exercising
+// client-side caching/304 behavior since repeat requests for the same key
+// see byte-identical content.
+func randomBlock(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+// writeBlock streams size bytes from block to w, repeating block as many
+// times as necessary.
+func writeBlock(w http.ResponseWriter, block []byte, size int) {
+	rem := size
+	for rem > 0 {
+		toSend := block
+		if rem < len(toSend) {
+			toSend = toSend[:rem]
+		}
+		sent, err := w.Write(toSend)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		rem -= sent
+	}
+}
+
 func reqLog(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := &loggingWriter{w: w, r: r, t: time.Now()}
@@ -137,88 +216,3 @@ func (w *loggingWriter) WriteHeader(statusCode int) {
 	atomic.StoreInt32(&w.status, int32(statusCode))
 	w.w.WriteHeader(statusCode)
 }
-
-// getCerts parses or generates a server cert.
-func getCerts(dir string) (string, string, error) {
-	certFile := filepath.Join(dir, "server.crt")
-	keyFile := filepath.Join(dir, "server.key")
-
-	os.Mkdir(dir, 0755)
-	os.Remove(certFile)
-	os.Remove(keyFile)
-
-	key, err := generateKey(keyFile)
-	if err != nil {
-		return "", "", err
-	}
-
-	_, err = generateCert(certFile, key)
-	if err != nil {
-		return "", "", err
-	}
-
-	return certFile, keyFile, nil
-}
-
-func generateKey(keyFile string) (*ecdsa.PrivateKey, error) {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-
-	keyDER, err := x509.MarshalECPrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to serialize private key for new certificate: %w", err)
-	}
-
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
-	if keyPEM == nil || len(keyPEM) < 1 {
-		return nil, fmt.Errorf("failed to PEM-encode generated certificate's key")
-	}
-
-	if err := os.WriteFile(keyFile, keyPEM, 0444); err != nil {
-		return nil, err
-	}
-
-	return key, nil
-}
-
-func generateCert(certFile string, key *ecdsa.PrivateKey) (*x509.Certificate, error) {
-	serialNumber, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate random serial number: %w", err)
-	}
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization:       []string{"Spraints"},
-			OrganizationalUnit: []string{"Exp"},
-			CommonName:         "localhost",
-		},
-		NotBefore:             time.Now().Add(-10 * time.Minute),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: false,
-		IPAddresses: []net.IP{
-			net.IPv4(127, 0, 0, 1),
-		},
-	}
-
-	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to perform certificate generation")
-	}
-
-	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
-	if certPem == nil || len(certPem) < 1 {
-		return nil, fmt.Errorf("failed to PEM-encode generated certificate")
-	}
-
-	if err := os.WriteFile(certFile, certPem, 0444); err != nil {
-		return nil, err
-	}
-
-	return x509.ParseCertificate(certDer)
-}